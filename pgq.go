@@ -3,10 +3,19 @@ package pgq
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/james-elicx/go-utils/utils"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/robfig/cron/v3"
 )
 
 const (
@@ -16,36 +25,325 @@ const (
 	JobStatusError   = "error"   // Job has been processed and resulted in an error
 )
 
-var TableName = "__pgq_jobs" // Name of the table used to store jobs
+const (
+	JobLogLevelInfo  = "info"  // Informational feedback message
+	JobLogLevelWarn  = "warn"  // Warning feedback message
+	JobLogLevelError = "error" // Error feedback message
+)
+
+// notifyChannelPrefix prefixes the Postgres LISTEN/NOTIFY channel used to wake up Run loops as
+// soon as a new job is put onto the queue, instead of waiting for the next poll tick. It's scoped
+// per schema and table (see Queue.notifyChannel) so that two Queues sharing a database, e.g. one
+// per tenant via WithSchema/WithTable, don't wake each other's Run loops just because they happen
+// to use the same job type name.
+const notifyChannelPrefix = "pgq_new_job"
+
+// defaultPollInterval is the PollInterval used by Run when none is given in RunOptions.
+const defaultPollInterval = 10 * time.Second
+
+// defaultMaxAttempts is the max_attempts given to a job whose handler was registered without
+// WithMaxAttempts, i.e. it is not retried on failure.
+const defaultMaxAttempts = 1
+
+// defaultBackoffBase and defaultBackoffCap parameterize DefaultBackoff.
+const (
+	defaultBackoffBase = 5 * time.Second
+	defaultBackoffCap  = time.Hour
+)
+
+// feedbackBatchSize and feedbackFlushInterval control how often a Feedback's buffered messages
+// are written to the job logs table: whichever limit is hit first triggers a flush.
+const (
+	feedbackBatchSize     = 20
+	feedbackFlushInterval = 2 * time.Second
+)
+
+// defaultCronPollInterval is the PollInterval used by RunCron when none is given in CronOptions.
+const defaultCronPollInterval = 30 * time.Second
+
+// cronParser accepts the standard 5-field cron spec plus an optional leading seconds field, so
+// both "* * * * *" and "*/5 * * * * *" are valid expressions for RegisterCron.
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// defaultTable is the base table name used by NewQueue when WithTable isn't given. The job logs
+// and cron schedules tables are derived from it by suffixing "_logs" and "_schedules".
+const defaultTable = "__pgq_jobs"
 
 // Queue is a queue of jobs.
 type Queue struct {
 	db       *sql.DB
-	handlers map[string]func(job Job) error
+	handlers map[string]handlerRegistration
+	crons    map[string]cronSchedule
+
+	schema string
+	table  string
+}
+
+// handlerRegistration holds a handler and the retry behaviour configured for it via
+// RegisterHandler's options.
+type handlerRegistration struct {
+	handler     func(ctx context.Context, job Job, fb Feedback) error
+	maxAttempts int
+	backoff     func(attempt int) time.Duration
+}
+
+// Feedback lets a handler emit progress messages while it runs. Messages are persisted to
+// the job logs table in the background so they survive past the handler returning, for post-mortem
+// inspection via Queue.JobLogs.
+type Feedback interface {
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// LegacyHandler adapts a handler using the pre-Feedback signature (func(job Job) error) to the
+// signature RegisterHandler now expects, for callers that don't need Feedback or a context.
+func LegacyHandler(handler func(job Job) error) func(ctx context.Context, job Job, fb Feedback) error {
+	return func(ctx context.Context, job Job, fb Feedback) error {
+		return handler(job)
+	}
+}
+
+// JobLog is a single feedback message recorded against a job, returned by Queue.JobLogs.
+type JobLog struct {
+	ID        int       // Log ID
+	JobID     int       // ID of the job the message was reported against
+	Level     string    // Severity of the message, one of the JobLogLevel* constants
+	Msg       string    // The message itself
+	CreatedAt time.Time // When the message was recorded
+}
+
+// feedbackMessage is a single message buffered by feedback before it's flushed to
+// the job logs table.
+type feedbackMessage struct {
+	level string
+	msg   string
+}
+
+// feedback is the Feedback implementation handed to handlers by pop. It buffers messages on a
+// channel and writes them to the job logs table in batches from a background goroutine, so
+// handlers aren't blocked on a database round trip for every message.
+type feedback struct {
+	q       *Queue
+	jobID   int
+	msgs    chan feedbackMessage
+	flushed chan struct{}
+}
+
+// newFeedback starts the background flush loop for a job and returns the Feedback handed to its
+// handler.
+func newFeedback(q *Queue, jobID int) *feedback {
+	fb := &feedback{
+		q:       q,
+		jobID:   jobID,
+		msgs:    make(chan feedbackMessage, feedbackBatchSize),
+		flushed: make(chan struct{}),
+	}
+
+	go fb.run()
+	return fb
+}
+
+func (fb *feedback) Info(msg string)  { fb.msgs <- feedbackMessage{level: JobLogLevelInfo, msg: msg} }
+func (fb *feedback) Warn(msg string)  { fb.msgs <- feedbackMessage{level: JobLogLevelWarn, msg: msg} }
+func (fb *feedback) Error(msg string) { fb.msgs <- feedbackMessage{level: JobLogLevelError, msg: msg} }
+
+// close stops accepting new messages and blocks until every buffered message has been flushed.
+func (fb *feedback) close() {
+	close(fb.msgs)
+	<-fb.flushed
+}
+
+// run batches messages off fb.msgs and flushes them to the job logs table, whichever of
+// feedbackBatchSize or feedbackFlushInterval is hit first. It returns once fb.msgs is closed and
+// drained.
+func (fb *feedback) run() {
+	defer close(fb.flushed)
+
+	ticker := time.NewTicker(feedbackFlushInterval)
+	defer ticker.Stop()
+
+	var batch []feedbackMessage
+	for {
+		select {
+		case m, ok := <-fb.msgs:
+			if !ok {
+				fb.flush(batch)
+				return
+			}
+
+			batch = append(batch, m)
+			if len(batch) >= feedbackBatchSize {
+				fb.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			fb.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+// flush writes batch to the job logs table. Failures are swallowed: feedback messages are
+// best-effort diagnostics and must never take down the handler that's reporting them.
+func (fb *feedback) flush(batch []feedbackMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	for _, m := range batch {
+		if _, err := fb.q.db.ExecContext(context.Background(), fmt.Sprintf(`
+			INSERT INTO %s (job_id, level, msg) VALUES ($1, $2, $3);
+		`, fb.q.JobLogsTableName()), fb.jobID, m.level, m.msg); err != nil {
+			return
+		}
+	}
+}
+
+// JobLogs returns the Feedback messages recorded against jobID, oldest first.
+func (q *Queue) JobLogs(ctx context.Context, jobID int) ([]JobLog, error) {
+	rows, err := q.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, job_id, level, msg, created_at FROM %s WHERE job_id = $1 ORDER BY id ASC
+	`, q.JobLogsTableName()), jobID)
+	if err != nil {
+		return nil, fmt.Errorf("queue: failed to fetch job logs: %w", err)
+	}
+	defer rows.Close()
+
+	var logs []JobLog
+	for rows.Next() {
+		var l JobLog
+		if err := rows.Scan(&l.ID, &l.JobID, &l.Level, &l.Msg, &l.CreatedAt); err != nil {
+			return nil, fmt.Errorf("queue: failed to scan job log: %w", err)
+		}
+		logs = append(logs, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("queue: failed to read job logs: %w", err)
+	}
+
+	return logs, nil
+}
+
+// QueueOption configures a Queue constructed via NewQueue.
+type QueueOption func(*Queue) error
+
+// WithSchema namespaces a Queue's tables under the given Postgres schema instead of the
+// database's default search path, so multiple independent queues (e.g. one per tenant) can
+// coexist without their tables colliding.
+func WithSchema(schema string) QueueOption {
+	return func(q *Queue) error {
+		if err := validateIdentifier(schema); err != nil {
+			return fmt.Errorf("queue: invalid schema: %w", err)
+		}
+		q.schema = schema
+		return nil
+	}
+}
+
+// WithTable overrides the base name of the table a Queue stores its jobs in. The job logs and
+// cron schedules tables are derived from it by suffixing "_logs" and "_schedules". Defaults to
+// "__pgq_jobs".
+func WithTable(table string) QueueOption {
+	return func(q *Queue) error {
+		if err := validateIdentifier(table); err != nil {
+			return fmt.Errorf("queue: invalid table: %w", err)
+		}
+		q.table = table
+		return nil
+	}
+}
+
+// validateIdentifier rejects identifiers containing quotes, since they'd otherwise let a schema
+// or table name break out of the quoting pgx.Identifier.Sanitize applies when it's built into SQL.
+func validateIdentifier(name string) error {
+	if strings.ContainsAny(name, `"'`) {
+		return fmt.Errorf("identifier %q must not contain quotes", name)
+	}
+	return nil
+}
+
+// qualify sanitizes name into a safely-quoted, schema-qualified SQL identifier.
+func (q *Queue) qualify(name string) string {
+	if q.schema == "" {
+		return pgx.Identifier{name}.Sanitize()
+	}
+	return pgx.Identifier{q.schema, name}.Sanitize()
+}
+
+// TableName returns the fully-qualified, quoted name of the table this Queue stores its jobs
+// in, for callers that need to query it directly.
+func (q *Queue) TableName() string {
+	return q.qualify(q.table)
+}
+
+// JobLogsTableName returns the fully-qualified, quoted name of the table this Queue stores
+// Feedback messages in.
+func (q *Queue) JobLogsTableName() string {
+	return q.qualify(q.table + "_logs")
+}
+
+// JobSchedulesTableName returns the fully-qualified, quoted name of the table this Queue stores
+// cron schedules in.
+func (q *Queue) JobSchedulesTableName() string {
+	return q.qualify(q.table + "_schedules")
+}
+
+// indexName returns a quoted index name derived from the Queue's base table name. Indexes live in
+// whichever schema their table does, so unlike TableName it isn't schema-qualified.
+func (q *Queue) indexName(suffix string) string {
+	return pgx.Identifier{"idx_" + q.table + suffix}.Sanitize()
+}
+
+// notifyChannel returns the raw (unquoted) name of this Queue's LISTEN/NOTIFY channel, derived
+// from its schema and table so that Queues on different tables don't share a channel (Queue
+// instances on the same schema and table do). pg_notify
+// takes the channel as a plain string rather than a SQL identifier, so callers building a LISTEN
+// statement must quote this themselves (e.g. with pgx.Identifier{...}.Sanitize()) while callers
+// of pg_notify pass it as-is.
+func (q *Queue) notifyChannel() string {
+	return notifyChannelPrefix + "_" + q.schema + "_" + q.table
 }
 
 // NewQueue creates a new queue with the given database.
-func NewQueue(db *sql.DB) *Queue {
-	return &Queue{
+func NewQueue(db *sql.DB, opts ...QueueOption) (*Queue, error) {
+	q := &Queue{
 		db:       db,
-		handlers: make(map[string]func(job Job) error),
+		handlers: make(map[string]handlerRegistration),
+		crons:    make(map[string]cronSchedule),
+		table:    defaultTable,
 	}
+
+	for _, opt := range opts {
+		if err := opt(q); err != nil {
+			return nil, err
+		}
+	}
+
+	return q, nil
 }
 
 // Job is a job in the queue.
 type Job struct {
-	ID         int            // Job ID
-	Type       string         // Type of job
-	Data       string         // Data for the job
-	Status     string         // Job status
-	Error      sql.NullString // Error message if the job failed
-	Attempt    int            // Number of times the job has been attempted
-	CreatedAt  time.Time      // When the job was created
-	StartedAt  sql.NullTime   // When the job was started
-	FinishedAt sql.NullTime   // When the job was finished
-}
-
-// SetupDatabase sets up the database for the queue, creating the table and indexes if they don't exist.
+	ID          int            // Job ID
+	Type        string         // Type of job
+	Data        string         // Data for the job
+	Status      string         // Job status
+	Error       sql.NullString // Error message if the job failed
+	Attempt     int            // Number of times the job has been attempted
+	MaxAttempts int            // Number of attempts allowed before the job is dead-lettered
+	RunAfter    time.Time      // Job will not be popped before this time
+	Priority    int16          // Higher values are popped before lower ones
+	CreatedAt   time.Time      // When the job was created
+	StartedAt   sql.NullTime   // When the job was started
+	FinishedAt  sql.NullTime   // When the job was finished
+}
+
+// SetupDatabase sets up the database for the queue, creating the table and indexes if they don't
+// exist. It's also safe to call against a database set up by an older version of this package:
+// columns added to the jobs table since (max_attempts, run_after, priority) are backfilled onto
+// it with ALTER TABLE ... ADD COLUMN IF NOT EXISTS, so CREATE TABLE IF NOT EXISTS no-opping on an
+// existing table doesn't leave it missing columns the rest of the package now assumes exist.
 func (q *Queue) SetupDatabase(ctx context.Context) error {
 	if _, err := q.db.ExecContext(ctx, fmt.Sprintf(`
 		CREATE TABLE IF NOT EXISTS %[1]s (
@@ -57,51 +355,241 @@ func (q *Queue) SetupDatabase(ctx context.Context) error {
 			status			TEXT NOT NULL DEFAULT '%[2]s',
 			error				TEXT,
 			attempt 		INT NOT NULL DEFAULT 0,
+			max_attempts INT NOT NULL DEFAULT 1,
+			run_after		TIMESTAMP NOT NULL DEFAULT NOW(),
+			priority		SMALLINT NOT NULL DEFAULT 0,
 
 			created_at	TIMESTAMP NOT NULL DEFAULT NOW(),
 			started_at	TIMESTAMP,
 			finished_at TIMESTAMP
 		);
 
-		CREATE INDEX IF NOT EXISTS idx_%[1]s_status ON %[1]s(status);
-	`, TableName, JobStatusWaiting)); err != nil {
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS max_attempts INT NOT NULL DEFAULT 1;
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS run_after TIMESTAMP NOT NULL DEFAULT NOW();
+		ALTER TABLE %[1]s ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0;
+
+		CREATE INDEX IF NOT EXISTS %[3]s ON %[1]s(status);
+		CREATE INDEX IF NOT EXISTS %[4]s ON %[1]s(priority DESC, id) WHERE status = '%[2]s';
+
+		CREATE TABLE IF NOT EXISTS %[5]s (
+			id SERIAL		PRIMARY KEY,
+
+			job_id			INT NOT NULL,
+			level				TEXT NOT NULL,
+			msg					TEXT NOT NULL,
+
+			created_at	TIMESTAMP NOT NULL DEFAULT NOW()
+		);
+
+		CREATE INDEX IF NOT EXISTS %[6]s ON %[5]s(job_id);
+
+		CREATE TABLE IF NOT EXISTS %[7]s (
+			job_type		TEXT PRIMARY KEY,
+
+			expr				TEXT NOT NULL,
+			next_run		TIMESTAMP NOT NULL,
+			last_run		TIMESTAMP
+		);
+	`, q.TableName(), JobStatusWaiting, q.indexName("_status"), q.indexName("_priority"), q.JobLogsTableName(), q.indexName("_logs_job_id"), q.JobSchedulesTableName())); err != nil {
 		return fmt.Errorf("queue: failed to setup database: %w", err)
 	}
 
 	return nil
 }
 
+// DefaultBackoff is the retry backoff used by handlers registered without WithBackoff: an
+// exponential delay capped at one hour, plus jitter of up to defaultBackoffBase, so retrying
+// workers don't all wake up at the same time.
+func DefaultBackoff(attempt int) time.Duration {
+	delay := defaultBackoffBase * time.Duration(math.Pow(2, float64(attempt)))
+	if delay <= 0 || delay > defaultBackoffCap {
+		delay = defaultBackoffCap
+	}
+
+	return delay + time.Duration(rand.Int63n(int64(defaultBackoffBase)))
+}
+
+// HandlerOption configures a handler registered via Queue.RegisterHandler.
+type HandlerOption func(*handlerRegistration)
+
+// WithMaxAttempts sets how many times a job of this type will be attempted before it is left in
+// the error status for dead-letter inspection instead of being retried. Defaults to 1.
+func WithMaxAttempts(n int) HandlerOption {
+	return func(r *handlerRegistration) {
+		r.maxAttempts = n
+	}
+}
+
+// WithBackoff overrides the function used to compute the delay before a failed job of this type
+// is retried. Defaults to DefaultBackoff.
+func WithBackoff(fn func(attempt int) time.Duration) HandlerOption {
+	return func(r *handlerRegistration) {
+		r.backoff = fn
+	}
+}
+
 // RegisterHandler registers a handler to the queue for the given job type.
 //
-// The handler will be called when a job of the given type is processed. If the handler returns
-// an error, the job will be marked as failed and the error will be stored in the database.
-func (q *Queue) RegisterHandler(jobType string, handler func(job Job) error) error {
+// The handler will be called when a job of the given type is processed. It may use fb to report
+// progress as it runs; those messages are persisted for later inspection via Queue.JobLogs. If
+// the handler returns an error, the job is retried with backoff until it has been attempted as
+// many times as WithMaxAttempts allows (once by default), after which it is left in the error
+// status with the handler's error kept as the terminal failure message.
+//
+// Handlers using the pre-Feedback signature can be passed through LegacyHandler.
+func (q *Queue) RegisterHandler(jobType string, handler func(ctx context.Context, job Job, fb Feedback) error, opts ...HandlerOption) error {
 	if _, ok := q.handlers[jobType]; ok {
 		return fmt.Errorf("queue: handler already registered for job type %s", jobType)
 	}
 
-	q.handlers[jobType] = handler
+	reg := handlerRegistration{
+		handler:     handler,
+		maxAttempts: defaultMaxAttempts,
+		backoff:     DefaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(&reg)
+	}
+
+	q.handlers[jobType] = reg
 	return nil
 }
 
+// PutOption configures a job added to the queue via Queue.Put or Queue.Enqueue.
+type PutOption func(*putConfig)
+
+type putConfig struct {
+	runAfter time.Time
+	priority int16
+}
+
+// WithRunAt schedules a job to not be popped before t.
+func WithRunAt(t time.Time) PutOption {
+	return func(c *putConfig) {
+		c.runAfter = t
+	}
+}
+
+// WithPriority sets the priority of a job. Jobs with a higher priority are popped before jobs
+// with a lower one, regardless of which was put on the queue first. Defaults to 0.
+func WithPriority(p int16) PutOption {
+	return func(c *putConfig) {
+		c.priority = p
+	}
+}
+
 // Put adds a job to the queue with the given job type and data.
-func (q *Queue) Put(ctx context.Context, jobType string, data string) error {
-	if _, ok := q.handlers[jobType]; !ok {
+func (q *Queue) Put(ctx context.Context, jobType string, data string, opts ...PutOption) error {
+	return q.putJob(ctx, jobType, data, opts)
+}
+
+// Enqueue adds a job to the queue with the given job type and data. It is an alias for Put.
+func (q *Queue) Enqueue(ctx context.Context, jobType string, data string, opts ...PutOption) error {
+	return q.putJob(ctx, jobType, data, opts)
+}
+
+// putJob inserts a job of the given type and notifies workers listening for that job type. The
+// insert and the notify run in the same transaction: Postgres defers NOTIFY delivery until
+// commit anyway, so this doesn't delay wakeups, but it does mean a failure that rolls back the
+// insert also correctly suppresses the notification, and a caller never sees the insert succeed
+// silently while the surrounding call reports an error.
+func (q *Queue) putJob(ctx context.Context, jobType string, data string, opts []PutOption) error {
+	reg, ok := q.handlers[jobType]
+	if !ok {
 		return fmt.Errorf("queue: no handler registered for job type %s", jobType)
 	}
 
-	if _, err := q.db.ExecContext(ctx, fmt.Sprintf(`
-		INSERT INTO %s (job_type, data) VALUES ($1, $2);
-	`, TableName), jobType, data); err != nil {
+	cfg := putConfig{runAfter: time.Now()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("queue: failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (job_type, data, max_attempts, run_after, priority) VALUES ($1, $2, $3, $4, $5);
+	`, q.TableName()), jobType, data, reg.maxAttempts, cfg.runAfter, cfg.priority); err != nil {
 		return fmt.Errorf("queue: failed to add job: %w", err)
 	}
 
+	if _, err := tx.ExecContext(ctx, `SELECT pg_notify($1, $2);`, q.notifyChannel(), jobType); err != nil {
+		return fmt.Errorf("queue: failed to notify workers of new job: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("queue: failed to commit transaction: %w", err)
+	}
+
 	return nil
 }
 
+// TypedJob is a job whose Data has been JSON-decoded into Params, used by handlers registered
+// with RegisterTyped.
+type TypedJob[T any] struct {
+	ID          int       // Job ID
+	Type        string    // Type of job
+	Params      T         // Decoded data for the job
+	Attempt     int       // Number of times the job has been attempted
+	MaxAttempts int       // Number of attempts allowed before the job is dead-lettered
+	Priority    int16     // Higher values are popped before lower ones
+	CreatedAt   time.Time // When the job was created
+}
+
+// RegisterTyped registers a handler for jobType that receives its data already JSON-decoded into
+// T, layered on top of RegisterHandler so it can be mixed with untyped handlers on the same
+// Queue.
+func RegisterTyped[T any](q *Queue, jobType string, handler func(ctx context.Context, job TypedJob[T]) error, opts ...HandlerOption) error {
+	return q.RegisterHandler(jobType, func(ctx context.Context, job Job, fb Feedback) error {
+		var params T
+		if err := json.Unmarshal([]byte(job.Data), &params); err != nil {
+			return fmt.Errorf("queue: failed to decode job data: %w", err)
+		}
+
+		return handler(ctx, TypedJob[T]{
+			ID:          job.ID,
+			Type:        job.Type,
+			Params:      params,
+			Attempt:     job.Attempt,
+			MaxAttempts: job.MaxAttempts,
+			Priority:    job.Priority,
+			CreatedAt:   job.CreatedAt,
+		})
+	}, opts...)
+}
+
+// PutTyped adds a job to the queue with the given job type, JSON-encoding payload into Data.
+func PutTyped[T any](ctx context.Context, q *Queue, jobType string, payload T, opts ...PutOption) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("queue: failed to encode job data: %w", err)
+	}
+
+	return q.Put(ctx, jobType, string(data), opts...)
+}
+
 // Pop pops a job from the queue that matches one of the given job types, and processes it using
 // the registered handler for the job type.
 func (q *Queue) Pop(ctx context.Context, jobTypes []string) error {
+	_, err := q.pop(ctx, jobTypes)
+	return err
+}
+
+// RunOptions configures the behaviour of Queue.Run.
+type RunOptions struct {
+	// PollInterval is the longest the loop will wait between pop attempts when no LISTEN/NOTIFY
+	// wakeup arrives first. Defaults to 10 seconds.
+	PollInterval time.Duration
+}
+
+// Run starts a blocking worker loop that pops and processes jobs of the given types until ctx is
+// cancelled. The loop wakes up either on PollInterval or as soon as Put notifies one of the given
+// job types via LISTEN/NOTIFY, whichever comes first, and drains every waiting job before going
+// back to sleep.
+func (q *Queue) Run(ctx context.Context, jobTypes []string, opts RunOptions) error {
 	if len(jobTypes) == 0 {
 		return fmt.Errorf("queue: no job type specified")
 	}
@@ -112,9 +600,258 @@ func (q *Queue) Pop(ctx context.Context, jobTypes []string) error {
 		}
 	}
 
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+
+	listener, err := q.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("queue: failed to acquire listener connection: %w", err)
+	}
+
+	// waitForNotifications blocks inside listener.Raw while it waits on the connection for a
+	// notification, and sql.Conn.Close blocks until any in-flight Raw call returns. listenCtx
+	// lets us unblock that wait ourselves before closing, so a real (non-shutdown) error further
+	// down doesn't leave Close hanging until ctx happens to be cancelled or another notification
+	// happens to arrive.
+	listenCtx, cancelListen := context.WithCancel(ctx)
+	defer func() {
+		cancelListen()
+		listener.Close()
+	}()
+
+	if err := listener.Raw(func(driverConn any) error {
+		conn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("queue: listener connection is not a pgx connection")
+		}
+		_, err := conn.Conn().Exec(ctx, "LISTEN "+pgx.Identifier{q.notifyChannel()}.Sanitize())
+		return err
+	}); err != nil {
+		return fmt.Errorf("queue: failed to listen for notifications: %w", err)
+	}
+
+	wake := make(chan struct{}, 1)
+	go q.waitForNotifications(listenCtx, listener, jobTypes, wake)
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			popped, err := q.pop(ctx, jobTypes)
+			if err != nil {
+				return err
+			}
+			if !popped {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// waitForNotifications blocks on the listener connection for notifications on this Queue's
+// notifyChannel, and signals wake whenever the notification payload matches one of jobTypes. It
+// returns once ctx is cancelled or the listener connection is no longer usable.
+func (q *Queue) waitForNotifications(ctx context.Context, listener *sql.Conn, jobTypes []string, wake chan<- struct{}) {
+	for {
+		var payload string
+
+		err := listener.Raw(func(driverConn any) error {
+			conn, ok := driverConn.(*stdlib.Conn)
+			if !ok {
+				return fmt.Errorf("queue: listener connection is not a pgx connection")
+			}
+
+			notification, err := conn.Conn().WaitForNotification(ctx)
+			if err != nil {
+				return err
+			}
+
+			payload = notification.Payload
+			return nil
+		})
+		if err != nil {
+			return
+		}
+
+		if !slices.Contains(jobTypes, payload) {
+			continue
+		}
+
+		select {
+		case wake <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StartConfig configures the worker pool spawned by Queue.Start.
+type StartConfig struct {
+	// JobTypes are the job types the pool processes. Required.
+	JobTypes []string
+
+	// MaxConcurrency is the total number of worker goroutines spawned across all job types.
+	// Required.
+	MaxConcurrency int
+
+	// MaxConcurrencyPerType optionally caps how many jobs of a given job type may be processed
+	// concurrently. Job types without an entry are only bounded by MaxConcurrency.
+	MaxConcurrencyPerType map[string]int
+
+	// PollInterval is the longest a worker will wait between pop attempts. Defaults to 10
+	// seconds.
+	PollInterval time.Duration
+}
+
+// Start spawns a pool of goroutines that process jobs of the given types concurrently, and
+// blocks until ctx is cancelled and every worker has finished the job it was in the middle of
+// processing. Each worker pops jobs through its own transaction, so FOR UPDATE SKIP LOCKED hands
+// out non-overlapping jobs across the pool. If a worker returns a genuine error (as opposed to
+// stopping because ctx was cancelled), the rest of the pool is stopped too rather than carrying
+// on understaffed, and that error is returned.
+func (q *Queue) Start(ctx context.Context, cfg StartConfig) error {
+	if len(cfg.JobTypes) == 0 {
+		return fmt.Errorf("queue: no job type specified")
+	}
+
+	for _, jobType := range cfg.JobTypes {
+		if _, ok := q.handlers[jobType]; !ok {
+			return fmt.Errorf("queue: no handler registered for job type %s", jobType)
+		}
+	}
+
+	if cfg.MaxConcurrency <= 0 {
+		return fmt.Errorf("queue: max concurrency must be greater than zero")
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = defaultPollInterval
+	}
+
+	perType := make(map[string]chan struct{}, len(cfg.MaxConcurrencyPerType))
+	for jobType, limit := range cfg.MaxConcurrencyPerType {
+		perType[jobType] = make(chan struct{}, limit)
+	}
+
+	errs := make(chan error, cfg.MaxConcurrency)
+
+	// workerCtx is cancelled the moment any worker returns a genuine error, so a single worker
+	// hitting a real DB failure stops the rest of the pool instead of leaving it running
+	// understaffed until the caller's ctx is eventually cancelled for an unrelated reason.
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(cfg.MaxConcurrency)
+	for i := 0; i < cfg.MaxConcurrency; i++ {
+		go func() {
+			defer wg.Done()
+			err := q.runWorker(workerCtx, cfg.JobTypes, perType, cfg.PollInterval)
+			if err != nil {
+				cancel()
+			}
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runWorker repeatedly pops and processes jobs of the given types until ctx is cancelled,
+// honouring the per-type concurrency limits in perType.
+func (q *Queue) runWorker(ctx context.Context, jobTypes []string, perType map[string]chan struct{}, pollInterval time.Duration) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		popped := false
+
+		for _, jobType := range jobTypes {
+			select {
+			case <-ctx.Done():
+				return nil
+			default:
+			}
+
+			sem, limited := perType[jobType]
+			if limited {
+				select {
+				case sem <- struct{}{}:
+				default:
+					continue // job type is at its concurrency cap, try the next one
+				}
+			}
+
+			ok, err := q.pop(ctx, []string{jobType})
+
+			if limited {
+				<-sem
+			}
+
+			if err != nil {
+				return err
+			}
+			popped = popped || ok
+		}
+
+		if popped {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// isShutdown reports whether err is (or wraps) context.Canceled, i.e. a database operation was
+// cut short by Run/Start's ctx being cancelled for graceful shutdown rather than by a real
+// failure.
+func isShutdown(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
+
+// pop pops a single job from the queue that matches one of the given job types, processes it
+// using the registered handler for the job type, and reports whether a job was found. If ctx is
+// cancelled while a database operation is in flight, pop treats that as the expected shutdown
+// signal from Run/Start and returns (false, nil) rather than propagating the cancellation as an
+// error.
+func (q *Queue) pop(ctx context.Context, jobTypes []string) (bool, error) {
+	if len(jobTypes) == 0 {
+		return false, fmt.Errorf("queue: no job type specified")
+	}
+
+	for _, jobType := range jobTypes {
+		if _, ok := q.handlers[jobType]; !ok {
+			return false, fmt.Errorf("queue: no handler registered for job type %s", jobType)
+		}
+	}
+
 	tx, err := q.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("queue: failed to start transaction: %w", err)
+		if isShutdown(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("queue: failed to start transaction: %w", err)
 	}
 	defer tx.Rollback()
 
@@ -128,29 +865,44 @@ func (q *Queue) Pop(ctx context.Context, jobTypes []string) error {
 			finished_at = NULL
 		WHERE id IN (
 			SELECT id FROM %[1]s AS jobs
-			WHERE jobs.status = $2 AND jobs.job_type = ANY($3)
-			ORDER BY jobs.id ASC
+			WHERE jobs.status = $2 AND jobs.job_type = ANY($3) AND jobs.run_after <= NOW()
+			ORDER BY jobs.priority DESC, jobs.id ASC
 			FOR UPDATE SKIP LOCKED
 			LIMIT 1
 		)
-		RETURNING id, job_type, data, status, error, attempt, created_at, started_at, finished_at
-	`, TableName), JobStatusRunning, JobStatusWaiting, jobTypes)
+		RETURNING id, job_type, data, status, error, attempt, max_attempts, run_after, priority, created_at, started_at, finished_at
+	`, q.TableName()), JobStatusRunning, JobStatusWaiting, jobTypes)
 
 	var job Job
 
-	if err = row.Scan(&job.ID, &job.Type, &job.Data, &job.Status, &job.Error, &job.Attempt, &job.CreatedAt, &job.StartedAt, &job.FinishedAt); err == sql.ErrNoRows {
-		return nil // should this return an error instead?
+	if err = row.Scan(&job.ID, &job.Type, &job.Data, &job.Status, &job.Error, &job.Attempt, &job.MaxAttempts, &job.RunAfter, &job.Priority, &job.CreatedAt, &job.StartedAt, &job.FinishedAt); err == sql.ErrNoRows {
+		return false, nil // should this return an error instead?
+	} else if isShutdown(err) {
+		return false, nil
 	} else if err != nil {
-		return fmt.Errorf("queue: failed to pop job: %w", err)
+		return false, fmt.Errorf("queue: failed to pop job: %w", err)
 	}
 
-	err = q.handlers[job.Type](job)
+	reg := q.handlers[job.Type]
+
+	fb := newFeedback(q, job.ID)
+	err = reg.handler(ctx, job, fb)
+	fb.close()
 
-	newStatus := utils.Ternary(err == nil, JobStatusDone, JobStatusError)
+	newStatus := JobStatusDone
+	newRunAfter := time.Now()
 	var newError *string
+
 	if err != nil {
-		newErrorStr := fmt.Sprintf("%s", err.Error())
+		newErrorStr := err.Error()
 		newError = &newErrorStr
+
+		if job.Attempt < job.MaxAttempts {
+			newStatus = JobStatusWaiting
+			newRunAfter = time.Now().Add(reg.backoff(job.Attempt))
+		} else {
+			newStatus = JobStatusError
+		}
 	}
 
 	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
@@ -158,14 +910,192 @@ func (q *Queue) Pop(ctx context.Context, jobTypes []string) error {
 		SET
 			status = $1,
 			error = $2,
+			run_after = $3,
 			finished_at = NOW()
-		WHERE id = $3
-	`, TableName), newStatus, newError, job.ID); err != nil {
-		return fmt.Errorf("queue: failed to update job status: %w", err)
+		WHERE id = $4
+	`, q.TableName()), newStatus, newError, newRunAfter, job.ID); err != nil {
+		if isShutdown(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("queue: failed to update job status: %w", err)
 	}
 
 	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("queue: failed to commit transaction: %w", err)
+		if isShutdown(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("queue: failed to commit transaction: %w", err)
 	}
+	return true, nil
+}
+
+// cronSchedule holds the parsed schedule and data source for a job type registered via
+// RegisterCron.
+type cronSchedule struct {
+	schedule  cron.Schedule
+	dataFn    func() string
+	uniqueKey bool
+}
+
+// CronOption configures a schedule registered via Queue.RegisterCron.
+type CronOption func(*cronSchedule)
+
+// WithUniqueKey skips a firing of the schedule if a job of the same type is already waiting or
+// running, so a slow-to-process job doesn't pile up duplicates behind it.
+func WithUniqueKey() CronOption {
+	return func(s *cronSchedule) {
+		s.uniqueKey = true
+	}
+}
+
+// RegisterCron schedules dataFn to be put on the queue as a jobType job every time cronExpr
+// fires, according to the standard 5-field cron syntax with an optional leading seconds field
+// (e.g. "0 */15 * * * *" or "*/15 * * * *"). jobType must already have a handler registered via
+// RegisterHandler or RegisterTyped.
+//
+// Schedules are persisted to the cron schedules table and claimed with FOR UPDATE SKIP LOCKED by
+// RunCron, so exactly one of any number of processes sharing the same schedule enqueues each
+// firing; every process that calls RegisterCron for a given jobType must be passed the same
+// cronExpr, since each call overwrites the stored expr and next_run, and whichever process claims
+// a firing advances next_run from its own in-memory schedule and builds the job from its own
+// dataFn.
+func (q *Queue) RegisterCron(ctx context.Context, jobType string, cronExpr string, dataFn func() string, opts ...CronOption) error {
+	if _, ok := q.handlers[jobType]; !ok {
+		return fmt.Errorf("queue: no handler registered for job type %s", jobType)
+	}
+
+	schedule, err := cronParser.Parse(cronExpr)
+	if err != nil {
+		return fmt.Errorf("queue: failed to parse cron expression: %w", err)
+	}
+
+	cs := cronSchedule{schedule: schedule, dataFn: dataFn}
+	for _, opt := range opts {
+		opt(&cs)
+	}
+	q.crons[jobType] = cs
+
+	nextRun := schedule.Next(time.Now())
+	if _, err := q.db.ExecContext(ctx, fmt.Sprintf(`
+		INSERT INTO %s (job_type, expr, next_run) VALUES ($1, $2, $3)
+		ON CONFLICT (job_type) DO UPDATE SET expr = $2, next_run = $3
+	`, q.JobSchedulesTableName()), jobType, cronExpr, nextRun); err != nil {
+		return fmt.Errorf("queue: failed to save cron schedule: %w", err)
+	}
+
 	return nil
 }
+
+// CronOptions configures the behaviour of Queue.RunCron.
+type CronOptions struct {
+	// PollInterval is the longest the loop will wait between checks for due schedules. Defaults
+	// to 30 seconds.
+	PollInterval time.Duration
+}
+
+// RunCron starts a blocking loop that enqueues a job every time one of this Queue's registered
+// cron schedules comes due, until ctx is cancelled. It claims due schedules with FOR UPDATE SKIP
+// LOCKED, so it's safe to run alongside other processes sharing the same schedules table.
+func (q *Queue) RunCron(ctx context.Context, opts CronOptions) error {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultCronPollInterval
+	}
+
+	ticker := time.NewTicker(opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			fired, err := q.fireDueCron(ctx)
+			if err != nil {
+				return err
+			}
+			if !fired {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// fireDueCron claims a single due schedule this process has a registration for, enqueues its
+// job unless WithUniqueKey is suppressing it, and reports whether a schedule was claimed.
+func (q *Queue) fireDueCron(ctx context.Context) (bool, error) {
+	registered := make([]string, 0, len(q.crons))
+	for jobType := range q.crons {
+		registered = append(registered, jobType)
+	}
+	if len(registered) == 0 {
+		return false, nil
+	}
+
+	tx, err := q.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("queue: failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// job_type = ANY($1) restricts the claim to schedules this process has a registration for,
+	// so a row belonging to a job type that's stale, renamed, or not yet registered here (normal
+	// during a rolling deploy) is left for another process to claim instead of being locked and
+	// then stuck, since SKIP LOCKED would otherwise hand it to us and nothing would ever advance
+	// its next_run.
+	row := tx.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT job_type FROM %s
+		WHERE next_run <= NOW() AND job_type = ANY($1)
+		ORDER BY next_run ASC
+		FOR UPDATE SKIP LOCKED
+		LIMIT 1
+	`, q.JobSchedulesTableName()), registered)
+
+	var jobType string
+	if err := row.Scan(&jobType); err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("queue: failed to claim due cron schedule: %w", err)
+	}
+
+	cs, ok := q.crons[jobType]
+	if !ok {
+		// The row was claimed under the job_type = ANY($1) filter above, which is built from
+		// q.crons, and RegisterCron only ever adds to q.crons, so jobType is always found here.
+		// This is only a guard: if it ever misses, the claim is rolled back and the row is skipped
+		// for this pass rather than erroring the whole RunCron loop.
+		return false, nil
+	}
+
+	skip := false
+	if cs.uniqueKey {
+		if err := tx.QueryRowContext(ctx, fmt.Sprintf(`
+			SELECT EXISTS(SELECT 1 FROM %s WHERE job_type = $1 AND status = ANY($2))
+		`, q.TableName()), jobType, []string{JobStatusWaiting, JobStatusRunning}).Scan(&skip); err != nil {
+			return false, fmt.Errorf("queue: failed to check for pending job: %w", err)
+		}
+	}
+
+	nextRun := cs.schedule.Next(time.Now())
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+		UPDATE %s SET next_run = $1, last_run = NOW() WHERE job_type = $2
+	`, q.JobSchedulesTableName()), nextRun, jobType); err != nil {
+		return false, fmt.Errorf("queue: failed to advance cron schedule: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("queue: failed to commit transaction: %w", err)
+	}
+
+	if skip {
+		return true, nil
+	}
+
+	if err := q.putJob(ctx, jobType, cs.dataFn(), nil); err != nil {
+		return false, fmt.Errorf("queue: failed to enqueue cron job: %w", err)
+	}
+
+	return true, nil
+}
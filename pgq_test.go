@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
 	"github.com/jackc/pgx/v5"
@@ -49,7 +51,10 @@ func TestMain(m *testing.M) {
 }
 
 func setupQueue(t *testing.T) (*pgq.Queue, context.Context) {
-	q := pgq.NewQueue(db)
+	q, err := pgq.NewQueue(db)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ctx := context.Background()
 	if err := q.SetupDatabase(ctx); err != nil {
@@ -62,7 +67,7 @@ func setupQueue(t *testing.T) (*pgq.Queue, context.Context) {
 func TestRegisterHandler(t *testing.T) {
 	q, _ := setupQueue(t)
 
-	handler := func(job pgq.Job) error {
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
 		return nil
 	}
 
@@ -78,7 +83,7 @@ func TestRegisterHandler(t *testing.T) {
 func TestPut(t *testing.T) {
 	q, ctx := setupQueue(t)
 
-	handler := func(job pgq.Job) error {
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
 		return nil
 	}
 
@@ -97,7 +102,7 @@ func TestPut(t *testing.T) {
 func TestPop(t *testing.T) {
 	q, ctx := setupQueue(t)
 
-	handler := func(job pgq.Job) error {
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
 		return nil
 	}
 
@@ -119,7 +124,7 @@ func TestPop(t *testing.T) {
 
 	// updates entry status to done
 	var job pgq.Job
-	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, job_type, data, status, error, attempt, created_at, started_at, finished_at FROM %s WHERE job_type = 'test_type' ORDER BY id ASC LIMIT 1", pgq.TableName))
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, job_type, data, status, error, attempt, created_at, started_at, finished_at FROM %s WHERE job_type = 'test_type' ORDER BY id ASC LIMIT 1", q.TableName()))
 	row.Scan(&job.ID, &job.Type, &job.Data, &job.Status, &job.Error, &job.Attempt, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
 
 	a.Equals(t, job.Type, "test_type")
@@ -131,7 +136,7 @@ func TestPop(t *testing.T) {
 func TestPopHandlerError(t *testing.T) {
 	q, ctx := setupQueue(t)
 
-	handler := func(job pgq.Job) error {
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
 		return fmt.Errorf("test error")
 	}
 
@@ -149,7 +154,7 @@ func TestPopHandlerError(t *testing.T) {
 
 	// updates entry status to error and adds error message
 	var job pgq.Job
-	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, job_type, data, status, error, attempt, created_at, started_at, finished_at FROM %s WHERE job_type = 'test_err_type' ORDER BY id ASC LIMIT 1", pgq.TableName))
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, job_type, data, status, error, attempt, created_at, started_at, finished_at FROM %s WHERE job_type = 'test_err_type' ORDER BY id ASC LIMIT 1", q.TableName()))
 	row.Scan(&job.ID, &job.Type, &job.Data, &job.Status, &job.Error, &job.Attempt, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
 
 	a.Equals(t, job.Type, "test_err_type")
@@ -158,3 +163,398 @@ func TestPopHandlerError(t *testing.T) {
 	a.Equals(t, job.Error.Valid, true)
 	a.Equals(t, job.Error.String, "test error")
 }
+
+func TestPopHandlerRetry(t *testing.T) {
+	q, ctx := setupQueue(t)
+
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		return fmt.Errorf("test error")
+	}
+
+	// register the handler with a retry budget of 2 attempts
+	err := q.RegisterHandler("test_retry_type", handler, pgq.WithMaxAttempts(2), pgq.WithBackoff(func(attempt int) time.Duration {
+		return time.Minute
+	}))
+	a.Equals(t, err, nil)
+
+	err = q.Put(ctx, "test_retry_type", "test_data")
+	a.Equals(t, err, nil)
+
+	// first failure is retried instead of dead-lettered
+	err = q.Pop(ctx, []string{"test_retry_type"})
+	a.Equals(t, err, nil)
+
+	var job pgq.Job
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, job_type, data, status, error, attempt, max_attempts, run_after, created_at, started_at, finished_at FROM %s WHERE job_type = 'test_retry_type' ORDER BY id ASC LIMIT 1", q.TableName()))
+	row.Scan(&job.ID, &job.Type, &job.Data, &job.Status, &job.Error, &job.Attempt, &job.MaxAttempts, &job.RunAfter, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+
+	a.Equals(t, job.Status, pgq.JobStatusWaiting)
+	a.Equals(t, job.Attempt, 1)
+	a.Equals(t, job.RunAfter.After(time.Now()), true)
+
+	// not yet due, so popping again finds nothing
+	err = q.Pop(ctx, []string{"test_retry_type"})
+	a.Equals(t, err, nil)
+
+	// make the retry due and exhaust the remaining attempt
+	_, err = db.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET run_after = NOW() WHERE id = $1", q.TableName()), job.ID)
+	a.Equals(t, err, nil)
+
+	err = q.Pop(ctx, []string{"test_retry_type"})
+	a.Equals(t, err, nil)
+
+	row = db.QueryRowContext(ctx, fmt.Sprintf("SELECT id, job_type, data, status, error, attempt, max_attempts, run_after, created_at, started_at, finished_at FROM %s WHERE job_type = 'test_retry_type' ORDER BY id ASC LIMIT 1", q.TableName()))
+	row.Scan(&job.ID, &job.Type, &job.Data, &job.Status, &job.Error, &job.Attempt, &job.MaxAttempts, &job.RunAfter, &job.CreatedAt, &job.StartedAt, &job.FinishedAt)
+
+	a.Equals(t, job.Status, pgq.JobStatusError)
+	a.Equals(t, job.Attempt, 2)
+}
+
+func TestEnqueueWithRunAt(t *testing.T) {
+	q, ctx := setupQueue(t)
+
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		return nil
+	}
+
+	err := q.RegisterHandler("test_scheduled_type", handler)
+	a.Equals(t, err, nil)
+
+	err = q.Enqueue(ctx, "test_scheduled_type", "test_data", pgq.WithRunAt(time.Now().Add(time.Hour)))
+	a.Equals(t, err, nil)
+
+	// not due yet
+	err = q.Pop(ctx, []string{"test_scheduled_type"})
+	a.Equals(t, err, nil)
+
+	var status string
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT status FROM %s WHERE job_type = 'test_scheduled_type' ORDER BY id ASC LIMIT 1", q.TableName()))
+	row.Scan(&status)
+	a.Equals(t, status, pgq.JobStatusWaiting)
+}
+
+func TestPopPriorityOrdering(t *testing.T) {
+	q, ctx := setupQueue(t)
+
+	var order []string
+
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		order = append(order, job.Data)
+		return nil
+	}
+
+	err := q.RegisterHandler("test_priority_type", handler)
+	a.Equals(t, err, nil)
+
+	a.Equals(t, q.Put(ctx, "test_priority_type", "low"), nil)
+	a.Equals(t, q.Put(ctx, "test_priority_type", "high", pgq.WithPriority(10)), nil)
+	a.Equals(t, q.Put(ctx, "test_priority_type", "medium", pgq.WithPriority(5)), nil)
+
+	for i := 0; i < 3; i++ {
+		a.Equals(t, q.Pop(ctx, []string{"test_priority_type"}), nil)
+	}
+
+	a.Equals(t, len(order), 3)
+	a.Equals(t, order[0], "high")
+	a.Equals(t, order[1], "medium")
+	a.Equals(t, order[2], "low")
+}
+
+type testTypedPayload struct {
+	Name string `json:"name"`
+}
+
+func TestRegisterTypedAndPutTyped(t *testing.T) {
+	q, ctx := setupQueue(t)
+
+	var received testTypedPayload
+
+	err := pgq.RegisterTyped(q, "test_typed_type", func(ctx context.Context, job pgq.TypedJob[testTypedPayload]) error {
+		received = job.Params
+		return nil
+	})
+	a.Equals(t, err, nil)
+
+	err = pgq.PutTyped(ctx, q, "test_typed_type", testTypedPayload{Name: "hello"})
+	a.Equals(t, err, nil)
+
+	err = q.Pop(ctx, []string{"test_typed_type"})
+	a.Equals(t, err, nil)
+
+	a.Equals(t, received.Name, "hello")
+}
+
+func TestPopFeedbackAndJobLogs(t *testing.T) {
+	q, ctx := setupQueue(t)
+
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		fb.Info("starting")
+		fb.Warn("careful")
+		return fmt.Errorf("test error")
+	}
+
+	err := q.RegisterHandler("test_feedback_type", handler)
+	a.Equals(t, err, nil)
+
+	err = q.Put(ctx, "test_feedback_type", "test_data")
+	a.Equals(t, err, nil)
+
+	err = q.Pop(ctx, []string{"test_feedback_type"})
+	a.Equals(t, err, nil)
+
+	var job pgq.Job
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT id FROM %s WHERE job_type = 'test_feedback_type' ORDER BY id ASC LIMIT 1", q.TableName()))
+	row.Scan(&job.ID)
+
+	// Pop only returns once the handler's feedback has been flushed
+	logs, err := q.JobLogs(ctx, job.ID)
+	a.Equals(t, err, nil)
+
+	a.Equals(t, len(logs), 2)
+	a.Equals(t, logs[0].Level, pgq.JobLogLevelInfo)
+	a.Equals(t, logs[0].Msg, "starting")
+	a.Equals(t, logs[1].Level, pgq.JobLogLevelWarn)
+	a.Equals(t, logs[1].Msg, "careful")
+}
+
+func TestLegacyHandler(t *testing.T) {
+	q, ctx := setupQueue(t)
+
+	var called bool
+
+	err := q.RegisterHandler("test_legacy_type", pgq.LegacyHandler(func(job pgq.Job) error {
+		called = true
+		return nil
+	}))
+	a.Equals(t, err, nil)
+
+	err = q.Put(ctx, "test_legacy_type", "test_data")
+	a.Equals(t, err, nil)
+
+	err = q.Pop(ctx, []string{"test_legacy_type"})
+	a.Equals(t, err, nil)
+
+	a.Equals(t, called, true)
+}
+
+func TestRun(t *testing.T) {
+	q, ctx := setupQueue(t)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var processed atomic.Bool
+
+	err := q.RegisterHandler("test_run_type", func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		processed.Store(true)
+		return nil
+	})
+	a.Equals(t, err, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Run(ctx, []string{"test_run_type"}, pgq.RunOptions{PollInterval: time.Second})
+	}()
+
+	err = q.Put(ctx, "test_run_type", "test_data")
+	a.Equals(t, err, nil)
+
+	// the notify wakeup should pick the job up well within the poll interval
+	time.Sleep(500 * time.Millisecond)
+	a.Equals(t, processed.Load(), true)
+
+	cancel()
+	a.Equals(t, <-done, nil)
+}
+
+func TestStartConcurrency(t *testing.T) {
+	q, ctx := setupQueue(t)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	const workers = 4
+
+	inFlight := make(chan struct{}, workers)
+	release := make(chan struct{})
+
+	err := q.RegisterHandler("test_concurrent_type", func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		inFlight <- struct{}{}
+		<-release
+		return nil
+	})
+	a.Equals(t, err, nil)
+
+	for i := 0; i < workers; i++ {
+		a.Equals(t, q.Put(ctx, "test_concurrent_type", "test_data"), nil)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Start(ctx, pgq.StartConfig{
+			JobTypes:       []string{"test_concurrent_type"},
+			MaxConcurrency: workers,
+			PollInterval:   time.Second,
+		})
+	}()
+
+	// all workers should be able to pick up a job at the same time
+	for i := 0; i < workers; i++ {
+		<-inFlight
+	}
+	close(release)
+
+	cancel()
+	a.Equals(t, <-done, nil)
+}
+
+func TestStartPerTypeConcurrency(t *testing.T) {
+	q, ctx := setupQueue(t)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var current, max, processed atomic.Int32
+
+	err := q.RegisterHandler("test_capped_type", func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		n := current.Add(1)
+		defer current.Add(-1)
+
+		for {
+			prev := max.Load()
+			if n <= prev || max.CompareAndSwap(prev, n) {
+				break
+			}
+		}
+
+		time.Sleep(100 * time.Millisecond)
+		processed.Add(1)
+		return nil
+	})
+	a.Equals(t, err, nil)
+
+	for i := 0; i < 4; i++ {
+		a.Equals(t, q.Put(ctx, "test_capped_type", "test_data"), nil)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.Start(ctx, pgq.StartConfig{
+			JobTypes:              []string{"test_capped_type"},
+			MaxConcurrency:        4,
+			MaxConcurrencyPerType: map[string]int{"test_capped_type": 1},
+			PollInterval:          50 * time.Millisecond,
+		})
+	}()
+
+	for processed.Load() < 4 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	a.Equals(t, <-done, nil)
+	a.Equals(t, max.Load(), int32(1))
+}
+
+func TestRegisterCronAndRunCron(t *testing.T) {
+	q, ctx := setupQueue(t)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	var processed atomic.Int32
+
+	err := q.RegisterHandler("test_cron_type", func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		processed.Add(1)
+		return nil
+	})
+	a.Equals(t, err, nil)
+
+	err = q.RegisterCron(ctx, "test_cron_type", "* * * * * *", func() string {
+		return "test_data"
+	})
+	a.Equals(t, err, nil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.RunCron(ctx, pgq.CronOptions{PollInterval: 50 * time.Millisecond})
+	}()
+
+	// RunCron only enqueues the job, so pop it here to run the handler
+	for processed.Load() < 1 {
+		a.Equals(t, q.Pop(ctx, []string{"test_cron_type"}), nil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	a.Equals(t, <-done, nil)
+}
+
+func TestRegisterCronWithUniqueKey(t *testing.T) {
+	q, ctx := setupQueue(t)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	release := make(chan struct{})
+	var started atomic.Int32
+
+	err := q.RegisterHandler("test_cron_unique_type", func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		started.Add(1)
+		<-release
+		return nil
+	})
+	a.Equals(t, err, nil)
+
+	err = q.RegisterCron(ctx, "test_cron_unique_type", "* * * * * *", func() string {
+		return "test_data"
+	}, pgq.WithUniqueKey())
+	a.Equals(t, err, nil)
+
+	cronDone := make(chan error, 1)
+	go func() {
+		cronDone <- q.RunCron(ctx, pgq.CronOptions{PollInterval: 50 * time.Millisecond})
+	}()
+
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- q.Run(ctx, []string{"test_cron_unique_type"}, pgq.RunOptions{PollInterval: 50 * time.Millisecond})
+	}()
+
+	for started.Load() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// a second firing shouldn't enqueue another job while the first is still running
+	time.Sleep(1200 * time.Millisecond)
+
+	var count int
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE job_type = 'test_cron_unique_type'", q.TableName()))
+	a.Equals(t, row.Scan(&count), nil)
+	a.Equals(t, count, 1)
+
+	close(release)
+	cancel()
+	a.Equals(t, <-cronDone, nil)
+	a.Equals(t, <-runDone, nil)
+}
+
+func TestNewQueueWithTable(t *testing.T) {
+	q, err := pgq.NewQueue(db, pgq.WithTable("__pgq_other_jobs"))
+	a.Equals(t, err, nil)
+
+	ctx := context.Background()
+	a.Equals(t, q.SetupDatabase(ctx), nil)
+
+	handler := func(ctx context.Context, job pgq.Job, fb pgq.Feedback) error {
+		return nil
+	}
+	a.Equals(t, q.RegisterHandler("test_table_type", handler), nil)
+	a.Equals(t, q.Put(ctx, "test_table_type", "test_data"), nil)
+	a.Equals(t, q.Pop(ctx, []string{"test_table_type"}), nil)
+
+	var count int
+	row := db.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE job_type = 'test_table_type'", q.TableName()))
+	a.Equals(t, row.Scan(&count), nil)
+	a.Equals(t, count, 1)
+}
+
+func TestNewQueueRejectsQuotedIdentifiers(t *testing.T) {
+	_, err := pgq.NewQueue(db, pgq.WithTable(`jobs"; DROP TABLE users; --`))
+	a.EqualsErrorMessage(t, err, `queue: invalid table: identifier "jobs\"; DROP TABLE users; --" must not contain quotes`)
+}